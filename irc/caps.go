@@ -0,0 +1,62 @@
+package irc
+
+import (
+	"strings"
+)
+
+// Capability represents a single IRCv3 client capability, e.g. "multi-prefix".
+type Capability string
+
+const (
+	MultiPrefix   Capability = "multi-prefix"
+	AwayNotify    Capability = "away-notify"
+	ServerTime    Capability = "server-time"
+	MessageTags   Capability = "message-tags"
+	AccountNotify Capability = "account-notify"
+	ExtendedJoin  Capability = "extended-join"
+	SASLCap       Capability = "sasl"
+)
+
+// SupportedCapabilities are the capabilities this server is able to negotiate.
+var SupportedCapabilities = CapSet{
+	MultiPrefix:   true,
+	AwayNotify:    true,
+	ServerTime:    true,
+	MessageTags:   true,
+	AccountNotify: true,
+	ExtendedJoin:  true,
+	SASLCap:       true,
+}
+
+// CapState tracks where a client is in the CAP negotiation handshake.
+type CapState uint
+
+const (
+	CapNone CapState = iota
+	CapNegotiating
+	CapNegotiated
+)
+
+// CapSet is a set of capabilities: those a client has requested and had
+// acknowledged, or (SupportedCapabilities) those the server offers.
+type CapSet map[Capability]bool
+
+func (set CapSet) Has(capability Capability) bool {
+	return set[capability]
+}
+
+func (set CapSet) Enable(capability Capability) {
+	set[capability] = true
+}
+
+func (set CapSet) Disable(capability Capability) {
+	delete(set, capability)
+}
+
+func (set CapSet) String() string {
+	strs := make([]string, 0, len(set))
+	for capability := range set {
+		strs = append(strs, string(capability))
+	}
+	return strings.Join(strs, " ")
+}
@@ -1,58 +1,149 @@
 package irc
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
+// COMMAND_QUEUE_LENGTH bounds each client's own command queue, so a burst of
+// input from one client can't grow without limit while its goroutine works
+// through a slow command.
+const COMMAND_QUEUE_LENGTH = 128
+
+// serverMutex serializes every HandleServer dispatch across all clients' own
+// goroutines. Giving each client its own queue (chunk0-3) parallelizes
+// per-client I/O (socket reads, command parsing/queuing, and now - since
+// Socket.Write just buffers and returns - reply delivery too), but mutation
+// of state shared across clients (server.clients, channel membership,
+// friends maps, nick registration) still has to happen on only one goroutine
+// at a time. This lock is that serialization point.
+var serverMutex sync.Mutex
+
 func IsNickname(nick string) bool {
 	return NicknameExpr.MatchString(nick)
 }
 
 type Client struct {
-	atime       time.Time
-	awayMessage string
-	channels    ChannelSet
-	ctime       time.Time
-	flags       map[UserMode]bool
-	friends     map[*Client]uint
-	hasQuit     bool
-	hops        uint
-	hostname    string
-	idleTimer   *time.Timer
-	loginTimer  *time.Timer
-	nick        string
-	phase       Phase
-	quitTimer   *time.Timer
-	realname    string
-	server      *Server
-	socket      *Socket
-	username    string
+	account        string
+	atime          time.Time
+	authorized     bool
+	awayMessage    string
+	capabilities   CapSet
+	capState       CapState
+	certfp         string
+	channels       ChannelSet
+	commands       chan Command
+	ctime          time.Time
+	done           chan struct{}
+	doneOnce       sync.Once
+	flags          map[UserMode]bool
+	friends        map[*Client]uint
+	hasQuit        bool
+	hops           uint
+	hostname       string
+	idleTimer      *time.Timer
+	loginTimer     *time.Timer
+	nick           string
+	phase          Phase
+	quitTimer      *time.Timer
+	realname       string
+	sasl           *saslState
+	secure         bool
+	server         *Server
+	socket         *Socket
+	tlsCipherSuite uint16
+	tlsVersion     uint16
+	username       string
 }
 
 func NewClient(server *Server, conn net.Conn) *Client {
 	now := time.Now()
 	client := &Client{
-		atime:    now,
-		channels: make(ChannelSet),
-		ctime:    now,
-		flags:    make(map[UserMode]bool),
-		friends:  make(map[*Client]uint),
-		hostname: AddrLookupHostname(conn.RemoteAddr()),
-		phase:    server.InitPhase(),
-		server:   server,
-		socket:   NewSocket(conn),
+		atime:        now,
+		capabilities: make(CapSet),
+		channels:     make(ChannelSet),
+		ctime:        now,
+		flags:        make(map[UserMode]bool),
+		friends:      make(map[*Client]uint),
+		hostname:     AddrLookupHostname(conn.RemoteAddr()),
+		phase:        server.InitPhase(),
+		server:       server,
+		socket:       NewSocket(conn),
 	}
 
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		client.secure = true
+		client.tlsVersion = state.Version
+		client.tlsCipherSuite = state.CipherSuite
+		client.certfp = certFingerprintFromState(state)
+	}
+
+	client.commands = make(chan Command, COMMAND_QUEUE_LENGTH)
+	client.done = make(chan struct{})
 	client.loginTimer = time.AfterFunc(LOGIN_TIMEOUT, client.connectionTimeout)
 	go client.readCommands()
+	go client.handleCommands()
 
 	return client
 }
 
+// certFingerprintFromState returns the SHA-256 fingerprint of the peer's TLS
+// client certificate, or "" if it presented none. This is used by SASL
+// EXTERNAL to authenticate clients by certificate.
+func certFingerprintFromState(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Secure returns whether this client is connected over TLS.
+func (client *Client) Secure() bool {
+	return client.secure
+}
+
+// CertFP returns the fingerprint of the client's TLS certificate, or "" if
+// it is not connected over TLS or presented no certificate.
+func (client *Client) CertFP() string {
+	return client.certfp
+}
+
+// TLSInfo returns a human-readable summary of the negotiated TLS version and
+// cipher suite, e.g. "TLSv1.3/TLS_AES_128_GCM_SHA256", or "" if the client
+// isn't connected over TLS. Surfaced to operators via OperHost and the
+// RPL_WHOISSECURE line built from it.
+func (client *Client) TLSInfo() string {
+	if !client.secure {
+		return ""
+	}
+	return tlsVersionName(client.tlsVersion) + "/" + tls.CipherSuiteName(client.tlsCipherSuite)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return "TLS"
+	}
+}
+
 //
 // socket read gorountine
 //
@@ -70,7 +161,7 @@ func (client *Client) readCommands() {
 		}
 
 		msg.SetClient(client)
-		client.server.commands <- msg
+		client.enqueueCommand(msg)
 	}
 
 	client.connectionClosed()
@@ -81,7 +172,41 @@ func (client *Client) connectionClosed() {
 		message: "connection closed",
 	}
 	msg.SetClient(client)
-	client.server.commands <- msg
+	client.enqueueCommand(msg)
+}
+
+//
+// per-client command goroutine
+//
+
+// enqueueCommand queues msg for this client's handleCommands goroutine,
+// giving up silently once the client has been torn down (client.done
+// closed) instead of sending on a queue nobody is draining any more.
+func (client *Client) enqueueCommand(msg Command) {
+	select {
+	case client.commands <- msg:
+	case <-client.done:
+	}
+}
+
+// handleCommands drains this client's own command queue, one command at a
+// time, until the client is torn down. Each client gets a dedicated
+// goroutine, so reading and queuing one client's input never waits on
+// another client's queue. Dispatch itself still runs under serverMutex, since
+// HandleServer mutates state shared across clients, so a slow command (WHOIS,
+// LIST, NAMES against a large channel) still delays every other client's
+// commands until it finishes.
+func (client *Client) handleCommands() {
+	for {
+		select {
+		case command := <-client.commands:
+			serverMutex.Lock()
+			command.HandleServer(client.server)
+			serverMutex.Unlock()
+		case <-client.done:
+			return
+		}
+	}
 }
 
 //
@@ -101,7 +226,7 @@ func (client *Client) connectionTimeout() {
 		message: "connection timeout",
 	}
 	msg.SetClient(client)
-	client.server.commands <- msg
+	client.enqueueCommand(msg)
 }
 
 //
@@ -135,16 +260,104 @@ func (client *Client) Idle() {
 }
 
 func (client *Client) Register() {
+	if client.phase == Normal {
+		return
+	}
+
+	if client.capState == CapNegotiating {
+		return
+	}
+
+	if client.server.RequiresSASL() && !client.authorized {
+		client.Reply(ErrSaslFail(client.server, client))
+		return
+	}
+
+	if accounts := client.server.accounts; accounts != nil {
+		if owner, reserved := accounts.NicknameOwner(client.nick); reserved && owner != client.account {
+			client.Reply(ErrNickLocked(client.server, client))
+			return
+		}
+	}
+
 	client.phase = Normal
 	client.loginTimer.Stop()
 	client.AddFriend(client)
 	client.Touch()
 }
 
+//
+// IRCv3 capability negotiation
+//
+
+// CapLS begins capability negotiation, suspending registration until CAP END.
+func (client *Client) CapLS() {
+	client.capState = CapNegotiating
+	client.Reply(RplCap(client.server, client, "LS", SupportedCapabilities.String()))
+}
+
+// CapList replies with the capabilities currently enabled for this client.
+func (client *Client) CapList() {
+	client.Reply(RplCap(client.server, client, "LIST", client.capabilities.String()))
+}
+
+// capChange is one token out of a CAP REQ list: a capability to enable, or
+// (with the "-" disable prefix) one to turn back off.
+type capChange struct {
+	capability Capability
+	disable    bool
+}
+
+// CapReq requests that the named capabilities be enabled or (with a "-"
+// prefix) disabled. Per IRCv3, the requested set is all-or-nothing: if every
+// capability is supported, they're all applied and ACKed with the exact
+// token list the client sent; if any is unsupported, none are applied and
+// the whole list is NAKed, so the server's negotiated state never diverges
+// from what a spec-compliant client believes it got.
+func (client *Client) CapReq(names []string) {
+	client.capState = CapNegotiating
+
+	changes := make([]capChange, 0, len(names))
+	for _, name := range names {
+		disable := strings.HasPrefix(name, "-")
+		capability := Capability(strings.TrimPrefix(name, "-"))
+		if !SupportedCapabilities.Has(capability) {
+			client.Reply(RplCap(client.server, client, "NAK", strings.Join(names, " ")))
+			return
+		}
+		changes = append(changes, capChange{capability: capability, disable: disable})
+	}
+
+	for _, change := range changes {
+		if change.disable {
+			client.capabilities.Disable(change.capability)
+		} else {
+			client.capabilities.Enable(change.capability)
+		}
+	}
+
+	client.Reply(RplCap(client.server, client, "ACK", strings.Join(names, " ")))
+}
+
+// CapEnd completes negotiation, unblocking registration.
+func (client *Client) CapEnd() {
+	client.capState = CapNegotiated
+	if client.HasNick() && client.HasUsername() {
+		client.Register()
+	}
+}
+
+// HasCapability reports whether the given capability has been negotiated for
+// this client, so the reply layer can tailor tags/prefixes per client.
+func (client *Client) HasCapability(capability Capability) bool {
+	return client.capabilities.Has(capability)
+}
+
 func (client *Client) Destroy() {
 	// clean up self
 
 	client.socket.Close()
+	client.doneOnce.Do(func() { close(client.done) })
 
 	client.loginTimer.Stop()
 	if client.idleTimer != nil {
@@ -170,7 +383,9 @@ func (client *Client) Destroy() {
 }
 
 func (client *Client) Reply(reply Reply) {
-	client.socket.Write(reply.Format(client)...)
+	if !client.socket.Write(reply.Format(client)...) {
+		client.Quit("SendQ exceeded")
+	}
 }
 
 func (client *Client) IdleTime() time.Duration {
@@ -199,6 +414,10 @@ func (c *Client) ModeString() (str string) {
 		str += flag.String()
 	}
 
+	if c.secure {
+		str += "Z"
+	}
+
 	if len(str) > 0 {
 		str = "+" + str
 	}
@@ -224,6 +443,20 @@ func (c *Client) Id() string {
 	return c.UserHost()
 }
 
+// OperHost returns connection details visible to operators (rDNS hostname
+// and, for TLS clients, the certificate fingerprint) beyond what UserHost
+// shows to ordinary users.
+func (c *Client) OperHost() string {
+	host := c.hostname
+	if c.certfp != "" {
+		host = fmt.Sprintf("%s certfp=%s", host, c.certfp)
+	}
+	if info := c.TLSInfo(); info != "" {
+		host = fmt.Sprintf("%s tls=%s", host, info)
+	}
+	return host
+}
+
 func (c *Client) String() string {
 	return c.Id()
 }
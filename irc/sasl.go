@@ -0,0 +1,135 @@
+package irc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+)
+
+// SASLMechanism identifies a supported SASL authentication mechanism.
+type SASLMechanism string
+
+const (
+	SASLPlain    SASLMechanism = "PLAIN"
+	SASLExternal SASLMechanism = "EXTERNAL"
+)
+
+// AccountStore validates credentials during SASL authentication. Servers are
+// configured with a concrete implementation, keeping the mechanism itself
+// decoupled from how accounts are actually persisted.
+type AccountStore interface {
+	// Authenticate validates a username/password pair, returning the
+	// canonical account name on success.
+	Authenticate(username, password string) (account string, err error)
+	// AuthenticateByCertFP validates a TLS client certificate fingerprint,
+	// returning the canonical account name on success.
+	AuthenticateByCertFP(fingerprint string) (account string, err error)
+	// NicknameOwner returns the account a nickname is registered to, and
+	// whether it's reserved at all. Used to reject registration with
+	// ERR_NICKLOCKED when a client authenticates as an account other than
+	// the one that owns its current nick.
+	NicknameOwner(nick string) (account string, reserved bool)
+}
+
+// saslState tracks an in-progress AUTHENTICATE exchange for a single client.
+type saslState struct {
+	mechanism SASLMechanism
+}
+
+// AuthenticateStart begins a SASL exchange for the given mechanism, as
+// requested by an AUTHENTICATE command with no payload yet.
+func (client *Client) AuthenticateStart(mechanism string) {
+	switch SASLMechanism(strings.ToUpper(mechanism)) {
+	case SASLPlain, SASLExternal:
+		client.sasl = &saslState{mechanism: SASLMechanism(strings.ToUpper(mechanism))}
+		client.Reply(RplAuthenticate(client, "+"))
+	default:
+		client.Reply(ErrSaslFail(client.server, client))
+	}
+}
+
+// AuthenticatePlain continues a PLAIN exchange with a base64-encoded
+// "authzid\0authcid\0password" payload.
+func (client *Client) AuthenticatePlain(payload string) {
+	if client.sasl == nil || client.sasl.mechanism != SASLPlain {
+		client.authenticateFail()
+		return
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		client.authenticateFail()
+		return
+	}
+
+	parts := bytes.SplitN(decoded, []byte{0}, 3)
+	if len(parts) != 3 {
+		client.authenticateFail()
+		return
+	}
+
+	account, err := client.server.accounts.Authenticate(string(parts[1]), string(parts[2]))
+	if err != nil {
+		client.authenticateFail()
+		return
+	}
+	client.authenticateSucceed(account)
+}
+
+// AuthenticateExternal continues an EXTERNAL exchange, authenticating the
+// client by the fingerprint of its TLS client certificate.
+func (client *Client) AuthenticateExternal() {
+	if client.sasl == nil || client.sasl.mechanism != SASLExternal {
+		client.authenticateFail()
+		return
+	}
+
+	if client.certfp == "" {
+		client.authenticateFail()
+		return
+	}
+
+	account, err := client.server.accounts.AuthenticateByCertFP(client.certfp)
+	if err != nil {
+		client.authenticateFail()
+		return
+	}
+	client.authenticateSucceed(account)
+}
+
+func (client *Client) authenticateSucceed(account string) {
+	client.authorized = true
+	client.account = account
+	client.sasl = nil
+	client.Reply(RplSaslSuccess(client.server, client))
+
+	// A client that already sent NICK/USER before finishing SASL may have had
+	// its earlier Register() call return early on !client.authorized; now that
+	// it's authorized, give registration another chance to complete (Register
+	// still waits for CAP END while negotiation is in progress).
+	if client.HasNick() && client.HasUsername() {
+		client.Register()
+	}
+}
+
+func (client *Client) authenticateFail() {
+	client.sasl = nil
+	client.Reply(ErrSaslFail(client.server, client))
+}
+
+// Account returns the account name bound to this client via SASL, or "" if
+// the client has not authenticated.
+func (client *Client) Account() string {
+	return client.account
+}
+
+// AccountOrStar returns the client's bound account, or "*" per the
+// account-notify/extended-join wire format when no account is bound. Reply
+// construction for JOIN and account-tag uses this to render the account
+// parameter/tag for this client.
+func (client *Client) AccountOrStar() string {
+	if client.account == "" {
+		return "*"
+	}
+	return client.account
+}
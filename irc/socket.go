@@ -0,0 +1,148 @@
+package irc
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSendQBytes bounds how many bytes of outbound traffic a client
+	// may have queued before it's considered unresponsive. A slow or
+	// stalled peer that blows through this limit is killed rather than
+	// allowed to backpressure the goroutine writing to it.
+	DefaultSendQBytes = 1024 * 1024
+
+	// writeTimeout bounds a single write to the underlying connection, so a
+	// peer that stops reading TCP data entirely can't wedge the writer
+	// goroutine forever.
+	writeTimeout = 10 * time.Second
+)
+
+// Socket wraps a net.Conn with a line-oriented reader and a buffered,
+// backpressured writer. Writes are appended to an in-memory buffer and
+// flushed by a dedicated goroutine, so a slow peer can never block the
+// goroutine producing replies for it. The buffer itself is bounded by bytes
+// (maxSendQ), not by a fixed queue capacity, so the SendQ limit is what
+// actually governs backpressure.
+type Socket struct {
+	conn     net.Conn
+	lines    chan string
+	maxSendQ int
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	buffer  [][]byte
+	pending int
+	closed  bool
+}
+
+func NewSocket(conn net.Conn) *Socket {
+	socket := &Socket{
+		conn:     conn,
+		lines:    make(chan string),
+		maxSendQ: DefaultSendQBytes,
+	}
+	socket.cond = sync.NewCond(&socket.mutex)
+
+	go socket.readLines()
+	go socket.writeLoop()
+
+	return socket
+}
+
+// Read returns the channel of incoming lines, closed once the connection is
+// gone.
+func (socket *Socket) Read() <-chan string {
+	return socket.lines
+}
+
+func (socket *Socket) readLines() {
+	reader := bufio.NewReader(socket.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if trimmed := strings.TrimRight(line, "\r\n"); trimmed != "" {
+			socket.lines <- trimmed
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(socket.lines)
+}
+
+// writeLoop drains the outbound buffer, blocking on socket.cond whenever
+// there's nothing to send, and exits once the socket is closed and the
+// buffer is empty.
+func (socket *Socket) writeLoop() {
+	socket.mutex.Lock()
+	for {
+		for len(socket.buffer) == 0 {
+			if socket.closed {
+				socket.mutex.Unlock()
+				return
+			}
+			socket.cond.Wait()
+		}
+
+		data := socket.buffer[0]
+		socket.buffer = socket.buffer[1:]
+		socket.pending -= len(data)
+		socket.mutex.Unlock()
+
+		socket.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		socket.conn.Write(data)
+
+		socket.mutex.Lock()
+	}
+}
+
+// Write appends the given lines to the outbound buffer and reports whether
+// they fit within the client's SendQ limit. A caller that gets false back
+// should disconnect the client rather than keep queuing more data for it.
+// Enqueuing happens entirely under socket.mutex, so it can never race with
+// Close: either the socket is already closed and Write is a no-op, or it
+// isn't and the data joins the buffer that writeLoop drains. Close does not
+// wait for that drain, so lines still buffered when it runs may be written
+// to an already-closed connection, in which case they are dropped.
+func (socket *Socket) Write(lines ...string) (ok bool) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
+	if socket.closed {
+		return true
+	}
+
+	ok = true
+	queued := false
+	for _, line := range lines {
+		data := []byte(line + "\r\n")
+		if socket.pending+len(data) > socket.maxSendQ {
+			ok = false
+			continue
+		}
+		socket.pending += len(data)
+		socket.buffer = append(socket.buffer, data)
+		queued = true
+	}
+
+	if queued {
+		socket.cond.Signal()
+	}
+	return ok
+}
+
+func (socket *Socket) Close() {
+	socket.mutex.Lock()
+	if socket.closed {
+		socket.mutex.Unlock()
+		return
+	}
+	socket.closed = true
+	socket.mutex.Unlock()
+
+	socket.cond.Broadcast()
+	socket.conn.Close()
+}